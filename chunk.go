@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultChunkSize is used when FileServerOptions.ChunkSize (or a
+// Sender's chunkSize) is left unset.
+const defaultChunkSize = 64 * 1024
+
+// numChunksFor returns how many chunkSize-sized chunks a file of size bytes
+// splits into, rounding up for a final partial chunk.
+func numChunksFor(size int64, chunkSize int) uint32 {
+	n := size / int64(chunkSize)
+	if size%int64(chunkSize) != 0 {
+		n++
+	}
+	return uint32(n)
+}
+
+// chunkHeaderSize is the size, in bytes, of a chunk's seq/len/crc32
+// header that precedes its payload within a MessageChunkData frame.
+const chunkHeaderSize = 4 + 4 + 4
+
+// encodeChunkPayload packs a TransferID and one chunk into a
+// MessageChunkData frame payload:
+// [1 idLen][id][4 seq][4 len][4 crc32][chunk bytes].
+func encodeChunkPayload(id TransferID, seq uint32, chunk []byte) []byte {
+	buf := make([]byte, 1+len(id)+chunkHeaderSize+len(chunk))
+
+	i := 0
+	buf[i] = byte(len(id))
+	i++
+	i += copy(buf[i:], id)
+
+	binary.LittleEndian.PutUint32(buf[i:], seq)
+	i += 4
+	binary.LittleEndian.PutUint32(buf[i:], uint32(len(chunk)))
+	i += 4
+	binary.LittleEndian.PutUint32(buf[i:], crc32.ChecksumIEEE(chunk))
+	i += 4
+
+	copy(buf[i:], chunk)
+	return buf
+}
+
+// decodeChunkPayload is the inverse of encodeChunkPayload. valid reports
+// whether the chunk's CRC32 matched; a corrupt chunk is still returned
+// (so the caller can log/NACK it) rather than treated as a decode error.
+func decodeChunkPayload(payload []byte) (id TransferID, seq uint32, chunk []byte, valid bool, err error) {
+	if len(payload) < 1 {
+		return "", 0, nil, false, errors.New("filestream: empty chunk payload")
+	}
+
+	idLen := int(payload[0])
+	if len(payload) < 1+idLen+chunkHeaderSize {
+		return "", 0, nil, false, errors.New("filestream: truncated chunk payload")
+	}
+	i := 1
+	id = TransferID(payload[i : i+idLen])
+	i += idLen
+
+	seq = binary.LittleEndian.Uint32(payload[i:])
+	i += 4
+	length := binary.LittleEndian.Uint32(payload[i:])
+	i += 4
+	wantCRC := binary.LittleEndian.Uint32(payload[i:])
+	i += 4
+
+	if len(payload) < i+int(length) {
+		return "", 0, nil, false, errors.New("filestream: truncated chunk data")
+	}
+	chunk = payload[i : i+int(length)]
+
+	return id, seq, chunk, crc32.ChecksumIEEE(chunk) == wantCRC, nil
+}
+
+// encodeChunkNack and its decoder pack the TransferID and offending
+// sequence number into a MessageChunkNack frame: [1 idLen][id][4 seq].
+func encodeChunkNack(id TransferID, seq uint32) []byte {
+	buf := make([]byte, 1+len(id)+4)
+	buf[0] = byte(len(id))
+	copy(buf[1:], id)
+	binary.LittleEndian.PutUint32(buf[1+len(id):], seq)
+	return buf
+}
+
+func decodeChunkNack(payload []byte) (TransferID, uint32, error) {
+	if len(payload) < 1 {
+		return "", 0, errors.New("filestream: empty chunk nack payload")
+	}
+	idLen := int(payload[0])
+	if len(payload) < 1+idLen+4 {
+		return "", 0, errors.New("filestream: truncated chunk nack payload")
+	}
+	id := TransferID(payload[1 : 1+idLen])
+	seq := binary.LittleEndian.Uint32(payload[1+idLen:])
+	return id, seq, nil
+}
+
+func writeChunkNack(w io.Writer, id TransferID, seq uint32) error {
+	return WriteFrame(w, &Frame{Type: MessageChunkNack, Payload: encodeChunkNack(id, seq)})
+}
+
+// chunkedReceive accumulates the chunks of one chunked transfer at their
+// correct file offsets, so retransmitted or reordered chunks land in the
+// right place regardless of arrival order.
+type chunkedReceive struct {
+	meta      FileMetadata
+	file      *os.File
+	chunkSize int
+
+	mu       sync.Mutex
+	baseline uint64            // bytes already accounted for from a previous connection
+	received map[uint32]uint32 // seq -> chunk length, for dedup and progress
+}
+
+// newChunkedReceive opens (or resumes) the destination file for meta.
+// baseline is the number of bytes already durably received for this
+// transfer before this connection, per the resume store.
+func newChunkedReceive(storageDir string, meta FileMetadata, chunkSize int, baseline int64) (*chunkedReceive, error) {
+	name, err := sanitizeFilename(meta.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(storageDir, name), os.O_CREATE|os.O_RDWR, os.FileMode(meta.Mode))
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkedReceive{
+		meta:      meta,
+		file:      file,
+		chunkSize: chunkSize,
+		baseline:  uint64(baseline),
+		received:  make(map[uint32]uint32),
+	}, nil
+}
+
+// seqInRange reports whether seq falls within the chunk count implied by
+// meta.Size, so a malicious or buggy seq can't make writeChunk seek (and
+// grow the destination file) far past the size the sender advertised.
+func (c *chunkedReceive) seqInRange(seq uint32) bool {
+	return seq < numChunksFor(int64(c.meta.Size), c.chunkSize)
+}
+
+// writeChunk writes chunk at its sequence number's offset.
+func (c *chunkedReceive) writeChunk(seq uint32, chunk []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offset := int64(seq) * int64(c.chunkSize)
+	if _, err := c.file.WriteAt(chunk, offset); err != nil {
+		return err
+	}
+	c.received[seq] = uint32(len(chunk))
+	return nil
+}
+
+// bytesReceived returns the number of distinct bytes accepted so far.
+func (c *chunkedReceive) bytesReceived() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	total := c.baseline
+	for _, n := range c.received {
+		total += uint64(n)
+	}
+	return total
+}
+
+// done reports whether every byte of the file has been received.
+func (c *chunkedReceive) done() bool {
+	return c.bytesReceived() >= c.meta.Size
+}
+
+// verify closes the file and hashes its full contents against the
+// advertised checksum. Chunks can land out of order, so unlike the
+// whole-blob path this re-reads the file rather than keeping a running
+// hash.
+func (c *chunkedReceive) verify() error {
+	defer c.file.Close()
+
+	if _, err := c.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, c.file); err != nil {
+		return err
+	}
+
+	if sum := hasher.Sum(nil); string(sum) != string(c.meta.SHA256[:]) {
+		return fmt.Errorf("filestream: checksum mismatch for %q", c.meta.Filename)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestNumChunksForRoundsUpPartialChunk(t *testing.T) {
+	cases := []struct {
+		size      int64
+		chunkSize int
+		want      uint32
+	}{
+		{0, 64, 0},
+		{64, 64, 1},
+		{65, 64, 2},
+		{127, 64, 2},
+		{128, 64, 2},
+	}
+	for _, c := range cases {
+		if got := numChunksFor(c.size, c.chunkSize); got != c.want {
+			t.Errorf("numChunksFor(%d, %d) = %d, want %d", c.size, c.chunkSize, got, c.want)
+		}
+	}
+}
+
+func TestSeqInRangeRejectsOutOfBoundsSeq(t *testing.T) {
+	meta := FileMetadata{
+		TransferID: "transfer-1",
+		Filename:   "payload.bin",
+		Size:       130, // 3 chunks of 64 bytes: seq 0, 1, 2
+		Mode:       0o644,
+		SHA256:     sha256.Sum256([]byte("irrelevant")),
+	}
+
+	c, err := newChunkedReceive(t.TempDir(), meta, 64, 0)
+	if err != nil {
+		t.Fatalf("newChunkedReceive: %v", err)
+	}
+
+	for _, seq := range []uint32{0, 1, 2} {
+		if !c.seqInRange(seq) {
+			t.Errorf("seqInRange(%d) = false, want true", seq)
+		}
+	}
+
+	for _, seq := range []uint32{3, 4_000_000} {
+		if c.seqInRange(seq) {
+			t.Errorf("seqInRange(%d) = true, want false (would write past %d bytes)", seq, meta.Size)
+		}
+	}
+}
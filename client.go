@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ClientOptions configures how a Client connects to a FileServer.
+type ClientOptions struct {
+	Network string
+	Address string
+
+	// TLSConfig, if set, dials with TLS instead of plain TCP.
+	TLSConfig *tls.Config
+
+	// MinIdle is the number of connections NewClient dials up front and
+	// keeps warm in the pool.
+	MinIdle int
+
+	// MaxIdle is the maximum number of idle connections Put will keep;
+	// anything beyond that is closed instead of pooled.
+	MaxIdle int
+}
+
+// Client sends files to a FileServer over a bounded pool of persistent
+// connections, so a single dial can be reused across many framed
+// transfers instead of paying a new TCP (and TLS) handshake per file.
+type Client struct {
+	opts ClientOptions
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+// NewClient builds a Client and warms its pool with MinIdle connections.
+func NewClient(opts ClientOptions) (*Client, error) {
+	if opts.MaxIdle < opts.MinIdle {
+		opts.MaxIdle = opts.MinIdle
+	}
+
+	c := &Client{opts: opts}
+
+	for i := 0; i < opts.MinIdle; i++ {
+		conn, err := c.dial()
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.idle = append(c.idle, conn)
+	}
+
+	return c, nil
+}
+
+func (c *Client) dial() (net.Conn, error) {
+	if c.opts.TLSConfig != nil {
+		return tls.Dial(c.opts.Network, c.opts.Address, c.opts.TLSConfig)
+	}
+	return net.Dial(c.opts.Network, c.opts.Address)
+}
+
+// Get returns a healthy connection from the pool, dialing a new one if
+// the pool is empty or every pooled connection fails its health check.
+func (c *Client) Get() (net.Conn, error) {
+	c.mu.Lock()
+	for len(c.idle) > 0 {
+		conn := c.idle[len(c.idle)-1]
+		c.idle = c.idle[:len(c.idle)-1]
+		c.mu.Unlock()
+
+		if healthy(conn) {
+			return conn, nil
+		}
+		conn.Close()
+
+		c.mu.Lock()
+	}
+	c.mu.Unlock()
+
+	return c.dial()
+}
+
+// Put returns conn to the pool for reuse, or closes it if the pool is
+// already at MaxIdle.
+func (c *Client) Put(conn net.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.idle) >= c.opts.MaxIdle {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// Close closes every pooled connection.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for _, conn := range c.idle {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.idle = nil
+	return firstErr
+}
+
+// healthy reports whether an idle connection is still usable, by giving
+// it a moment to prove the peer hasn't closed it in the meantime.
+func healthy(conn net.Conn) bool {
+	if err := conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	one := make([]byte, 1)
+	_, err := conn.Read(one)
+	switch {
+	case err == nil:
+		// Unexpected data waiting on an idle connection would desync the
+		// framed protocol, so treat it as unusable rather than risk that.
+		return false
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return true
+	default:
+		return false
+	}
+}
+
+// SendFile sends file to the server as transfer id, resuming from
+// whatever offset the server reports it has already received.
+func (c *Client) SendFile(id TransferID, filename string, file []byte) error {
+	conn, err := c.Get()
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendFile(conn, id, filename, file); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.Put(conn)
+	return nil
+}
+
+// OpenSession gets a pooled connection and wraps it in a Session, so
+// multiple files can be sent concurrently as independent streams without
+// each one dialing (or blocking on) its own connection.
+func (c *Client) OpenSession() (*Session, error) {
+	conn, err := c.Get()
+	if err != nil {
+		return nil, err
+	}
+	return NewSession(conn), nil
+}
+
+// SendFileOnStream runs the same metadata/data handshake as SendFile, but
+// over an existing multiplexed Stream instead of a whole connection.
+func (c *Client) SendFileOnStream(stream *Stream, id TransferID, filename string, file []byte) error {
+	return c.sendFile(stream, id, filename, file)
+}
+
+// SendFileChunked sends file to the server as transfer id split into
+// chunkSize, CRC-checked chunks (defaultChunkSize if chunkSize is <= 0),
+// resuming from whatever offset the server reports it has already
+// received and letting the Sender retransmit any chunk the server NACKs
+// as corrupt.
+func (c *Client) SendFileChunked(id TransferID, filename string, file []byte, chunkSize int) error {
+	conn, err := c.Get()
+	if err != nil {
+		return err
+	}
+
+	if err := c.sendFileChunked(conn, id, filename, file, chunkSize); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c.Put(conn)
+	return nil
+}
+
+func (c *Client) sendFileChunked(rw io.ReadWriter, id TransferID, filename string, file []byte, chunkSize int) error {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	// Ask the server how much of this transfer it has already received, so
+	// a reconnecting client resumes instead of re-sending the whole file.
+	if err := WriteFrame(rw, &Frame{Type: MessageQueryOffset, Payload: []byte(id)}); err != nil {
+		return err
+	}
+
+	reply, err := ReadFrame(rw)
+	if err != nil {
+		return err
+	}
+	offset, err := readOffset(reply)
+	if err != nil {
+		return err
+	}
+
+	meta := FileMetadata{
+		TransferID: id,
+		Filename:   filename,
+		Size:       uint64(len(file)),
+		Mode:       0o644,
+		ModTime:    time.Now(),
+		SHA256:     sha256.Sum256(file),
+		Chunked:    true,
+	}
+	if err := WriteFrame(rw, &Frame{Type: MessageMetadata, Payload: encodeMetadata(meta)}); err != nil {
+		return err
+	}
+
+	startSeq := uint32(offset / int64(chunkSize))
+	sender := NewSender(id, bytes.NewReader(file), int64(len(file)), chunkSize)
+	if err := sender.SendTo(rw, startSeq); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sent %d bytes as chunks (resumed from offset %d)\n", len(file), offset)
+	fmt.Printf("Server confirmed transfer %q\n", id)
+	return nil
+}
+
+func (c *Client) sendFile(rw io.ReadWriter, id TransferID, filename string, file []byte) error {
+	// Ask the server how much of this transfer it has already received, so
+	// a reconnecting client resumes instead of re-sending the whole file.
+	if err := WriteFrame(rw, &Frame{Type: MessageQueryOffset, Payload: []byte(id)}); err != nil {
+		return err
+	}
+
+	reply, err := ReadFrame(rw)
+	if err != nil {
+		return err
+	}
+	offset, err := readOffset(reply)
+	if err != nil {
+		return err
+	}
+
+	meta := FileMetadata{
+		TransferID: id,
+		Filename:   filename,
+		Size:       uint64(len(file)),
+		Mode:       0o644,
+		ModTime:    time.Now(),
+		SHA256:     sha256.Sum256(file),
+	}
+	if err := WriteFrame(rw, &Frame{Type: MessageMetadata, Payload: encodeMetadata(meta)}); err != nil {
+		return err
+	}
+
+	// Seek to the offset the server reported and send only what's left.
+	remaining := io.NewSectionReader(bytes.NewReader(file), offset, int64(len(file))-offset)
+	chunk, err := io.ReadAll(remaining)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteFrame(rw, &Frame{Type: MessageData, Payload: encodeDataPayload(id, chunk)}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Sent %d of %d bytes (resumed from offset %d)\n", len(chunk), len(file), offset)
+
+	ack, err := ReadFrame(rw)
+	if err != nil {
+		return err
+	}
+	switch ack.Type {
+	case MessageAck:
+		fmt.Printf("Server confirmed transfer %q\n", id)
+		return nil
+	case MessageNack:
+		return fmt.Errorf("filestream: server rejected transfer %q: %s", id, ack.Payload)
+	default:
+		return fmt.Errorf("filestream: unexpected reply type %d after data", ack.Type)
+	}
+}
+
+// randomFile generates size random bytes, standing in for reading a real
+// file from disk in the demo.
+func randomFile(size int) ([]byte, error) {
+	file := make([]byte, size)
+	if _, err := io.ReadFull(rand.Reader, file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
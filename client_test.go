@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// newTestListener starts a listener that accepts and holds connections open
+// (so the client's health check and pool logic have something real to
+// dial), closing them all when the test ends.
+func newTestListener(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestClientPoolWarmsAndRespectsMaxIdle(t *testing.T) {
+	addr := newTestListener(t)
+
+	c, err := NewClient(ClientOptions{Network: "tcp", Address: addr, MinIdle: 2, MaxIdle: 2})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	defer c.Close()
+
+	if got := len(c.idle); got != 2 {
+		t.Fatalf("idle pool after NewClient = %d, want 2", got)
+	}
+
+	conn, err := c.Get()
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if got := len(c.idle); got != 1 {
+		t.Fatalf("idle pool after Get = %d, want 1", got)
+	}
+
+	extra, err := c.dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	c.Put(conn)
+	c.Put(extra) // pool is already back at MaxIdle, so this one should be closed instead of pooled
+
+	if got := len(c.idle); got != 2 {
+		t.Fatalf("idle pool after Put beyond MaxIdle = %d, want 2", got)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+)
+
+// frameMagic identifies the start of a frame so a reader can immediately
+// reject garbage or a stream that has fallen out of sync, instead of
+// silently misinterpreting random bytes as a length.
+const frameMagic uint32 = 0x46535401 // "FST" + protocol version 1
+
+// frameVersion is the protocol version encoded in every frame header.
+// Bump this if the header layout ever changes.
+const frameVersion uint8 = 1
+
+// frameHeaderSize is the fixed on-wire size, in bytes, of a frame header:
+// magic(4) + version(1) + type(1) + flags(1) + length(8) + crc32(4).
+const frameHeaderSize = 19
+
+// maxFrameLength caps the payload size ReadFrame will allocate for. The
+// header's Length field is attacker-controlled and only CRC-protected
+// against corruption, not against a peer simply lying about it, so it must
+// be bounded before use in make([]byte, ...) or a single frame can exhaust
+// memory or panic the reading goroutine.
+const maxFrameLength = 64 << 20 // 64 MiB
+
+// MessageType identifies what kind of payload a frame carries.
+type MessageType uint8
+
+const (
+	// MessageData carries a chunk of file payload, prefixed with the ID of
+	// the transfer it belongs to (see encodeDataPayload).
+	MessageData MessageType = iota + 1
+
+	// MessageQueryOffset asks the server how many bytes of a given
+	// transfer it has already durably received.
+	MessageQueryOffset
+
+	// MessageOffset replies to a MessageQueryOffset with the number of
+	// bytes already received, so the client can resume from there.
+	MessageOffset
+
+	// MessageMetadata carries a FileMetadata envelope and must be sent
+	// before any MessageData frames for the transfer it describes.
+	MessageMetadata
+
+	// MessageAck confirms a transfer was received intact.
+	MessageAck
+
+	// MessageNack reports that a transfer failed (e.g. a checksum
+	// mismatch); its payload is the transfer ID, a NUL byte, then a
+	// human-readable reason (see writeNack).
+	MessageNack
+
+	// MessageStreamData carries a chunk of payload for one multiplexed
+	// Stream within a Session, prefixed with that stream's ID.
+	MessageStreamData
+
+	// MessageWindowUpdate grants the peer additional bytes it may send on
+	// a stream before it must block on flow control.
+	MessageWindowUpdate
+
+	// MessageStreamClose signals that no more data will be sent on a
+	// stream.
+	MessageStreamClose
+
+	// MessageChunkData carries one fixed-size, CRC-checked chunk of a
+	// chunked transfer (see chunk.go).
+	MessageChunkData
+
+	// MessageChunkNack reports that a specific chunk arrived corrupt and
+	// asks the sender to retransmit just that one.
+	MessageChunkNack
+)
+
+// encodeDataPayload packs a TransferID and a chunk of file bytes into a
+// single MessageData frame payload: [1 byte id length][id][chunk].
+func encodeDataPayload(id TransferID, chunk []byte) []byte {
+	buf := make([]byte, 1+len(id)+len(chunk))
+	buf[0] = byte(len(id))
+	copy(buf[1:], id)
+	copy(buf[1+len(id):], chunk)
+	return buf
+}
+
+// decodeDataPayload is the inverse of encodeDataPayload.
+func decodeDataPayload(payload []byte) (TransferID, []byte, error) {
+	if len(payload) < 1 {
+		return "", nil, errors.New("filestream: empty data payload")
+	}
+
+	idLen := int(payload[0])
+	if len(payload) < 1+idLen {
+		return "", nil, errors.New("filestream: truncated data payload")
+	}
+
+	id := TransferID(payload[1 : 1+idLen])
+	chunk := payload[1+idLen:]
+	return id, chunk, nil
+}
+
+// writeOffset sends a MessageOffset frame reporting offset bytes received.
+func writeOffset(w io.Writer, offset int64) error {
+	payload := make([]byte, 8)
+	binary.LittleEndian.PutUint64(payload, uint64(offset))
+	return WriteFrame(w, &Frame{Type: MessageOffset, Payload: payload})
+}
+
+// readOffset reads and validates a MessageOffset frame's payload.
+func readOffset(f *Frame) (int64, error) {
+	if f.Type != MessageOffset || len(f.Payload) != 8 {
+		return 0, errors.New("filestream: expected an offset reply")
+	}
+	return int64(binary.LittleEndian.Uint64(f.Payload)), nil
+}
+
+// FrameFlags are bit flags carried in the frame header. None are defined
+// yet, but the field is reserved on the wire so it doesn't require a
+// protocol version bump later.
+type FrameFlags uint8
+
+// Frame is a single length-prefixed protocol message: a fixed header
+// followed by exactly len(Payload) bytes.
+type Frame struct {
+	Type    MessageType
+	Flags   FrameFlags
+	Payload []byte
+}
+
+// header is the on-wire representation of a Frame's fixed-size preamble.
+type header struct {
+	Magic   uint32
+	Version uint8
+	Type    MessageType
+	Flags   FrameFlags
+	Length  uint64
+	CRC32   uint32 // checksum of the fields above, used to detect a corrupt or desynced header
+}
+
+var (
+	errBadMagic           = errors.New("filestream: bad frame magic")
+	errUnsupportedVersion = errors.New("filestream: unsupported frame version")
+	errBadHeaderCRC       = errors.New("filestream: frame header checksum mismatch")
+	errFrameTooLarge      = errors.New("filestream: frame length exceeds maxFrameLength")
+)
+
+// WriteFrame writes f to w as a framed message: header, then payload.
+func WriteFrame(w io.Writer, f *Frame) error {
+	h := header{
+		Magic:   frameMagic,
+		Version: frameVersion,
+		Type:    f.Type,
+		Flags:   f.Flags,
+		Length:  uint64(len(f.Payload)),
+	}
+	h.CRC32 = headerCRC(h)
+
+	buf := make([]byte, frameHeaderSize)
+	encodeHeader(buf, h)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	if len(f.Payload) == 0 {
+		return nil
+	}
+	_, err := w.Write(f.Payload)
+	return err
+}
+
+// ReadFrame reads a single framed message from r, blocking until a full
+// header and payload have arrived or an error occurs. Callers loop over
+// ReadFrame to receive multiple messages on the same connection.
+func ReadFrame(r io.Reader) (*Frame, error) {
+	buf := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+
+	h := decodeHeader(buf)
+	if h.Magic != frameMagic {
+		return nil, errBadMagic
+	}
+	if h.Version != frameVersion {
+		return nil, errUnsupportedVersion
+	}
+	if h.CRC32 != headerCRC(h) {
+		return nil, errBadHeaderCRC
+	}
+	if h.Length > maxFrameLength {
+		return nil, errFrameTooLarge
+	}
+
+	payload := make([]byte, h.Length)
+	if h.Length > 0 {
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Frame{Type: h.Type, Flags: h.Flags, Payload: payload}, nil
+}
+
+// headerCRC computes the checksum of a header's fields, excluding the
+// checksum field itself.
+func headerCRC(h header) uint32 {
+	buf := make([]byte, frameHeaderSize-4)
+	putHeaderFields(buf, h)
+	return crc32.ChecksumIEEE(buf)
+}
+
+func encodeHeader(buf []byte, h header) {
+	putHeaderFields(buf, h)
+	binary.LittleEndian.PutUint32(buf[15:19], h.CRC32)
+}
+
+func putHeaderFields(buf []byte, h header) {
+	binary.LittleEndian.PutUint32(buf[0:4], h.Magic)
+	buf[4] = h.Version
+	buf[5] = byte(h.Type)
+	buf[6] = byte(h.Flags)
+	binary.LittleEndian.PutUint64(buf[7:15], h.Length)
+}
+
+func decodeHeader(buf []byte) header {
+	return header{
+		Magic:   binary.LittleEndian.Uint32(buf[0:4]),
+		Version: buf[4],
+		Type:    MessageType(buf[5]),
+		Flags:   FrameFlags(buf[6]),
+		Length:  binary.LittleEndian.Uint64(buf[7:15]),
+		CRC32:   binary.LittleEndian.Uint32(buf[15:19]),
+	}
+}
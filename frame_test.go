@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	want := &Frame{Type: MessageData, Flags: 0, Payload: []byte("hello world")}
+
+	if err := WriteFrame(&buf, want); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+
+	got, err := ReadFrame(&buf)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if got.Type != want.Type || !bytes.Equal(got.Payload, want.Payload) {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, want)
+	}
+}
+
+func TestReadFrameBadMagic(t *testing.T) {
+	buf := make([]byte, frameHeaderSize)
+	if _, err := ReadFrame(bytes.NewReader(buf)); err != errBadMagic {
+		t.Fatalf("got %v, want errBadMagic", err)
+	}
+}
+
+func TestReadFrameBadHeaderCRC(t *testing.T) {
+	h := header{Magic: frameMagic, Version: frameVersion, Type: MessageData}
+	buf := make([]byte, frameHeaderSize)
+	encodeHeader(buf, h) // CRC32 left as zero, which won't match headerCRC(h)
+
+	if _, err := ReadFrame(bytes.NewReader(buf)); err != errBadHeaderCRC {
+		t.Fatalf("got %v, want errBadHeaderCRC", err)
+	}
+}
+
+// TestReadFrameRejectsOversizedLength reproduces a peer that claims a huge
+// payload length in an otherwise well-formed header: ReadFrame must reject
+// it before allocating, not panic with makeslice: len out of range.
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	h := header{
+		Magic:   frameMagic,
+		Version: frameVersion,
+		Type:    MessageData,
+		Length:  ^uint64(0),
+	}
+	h.CRC32 = headerCRC(h)
+
+	buf := make([]byte, frameHeaderSize)
+	encodeHeader(buf, h)
+
+	_, err := ReadFrame(bytes.NewReader(buf))
+	if err != errFrameTooLarge {
+		t.Fatalf("got %v, want errFrameTooLarge", err)
+	}
+}
+
+func TestReadFrameTruncatedPayload(t *testing.T) {
+	h := header{Magic: frameMagic, Version: frameVersion, Type: MessageData, Length: 4}
+	h.CRC32 = headerCRC(h)
+
+	buf := make([]byte, frameHeaderSize)
+	encodeHeader(buf, h)
+	buf = append(buf, byte(1), byte(2)) // fewer than the 4 bytes promised
+
+	if _, err := ReadFrame(bytes.NewReader(buf)); err == nil {
+		t.Fatal("expected an error for a truncated payload, got nil")
+	}
+}
+
+func TestEncodeHeaderLittleEndianLength(t *testing.T) {
+	h := header{Length: 0x0102030405060708}
+	buf := make([]byte, frameHeaderSize)
+	putHeaderFields(buf, h)
+
+	if got := binary.LittleEndian.Uint64(buf[7:15]); got != h.Length {
+		t.Fatalf("got length %x, want %x", got, h.Length)
+	}
+}
@@ -1,134 +1,449 @@
 package main
 
 import (
-	"bytes"
-	"crypto/rand"
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// defaultMaxConns is used when FileServerOptions.MaxConns is left unset.
+const defaultMaxConns = 256
+
 // FileServer is the file server
 type FileServer struct {
-	Opts FileServerOptions
+	Opts  FileServerOptions
+	store resumeStore
+
+	listener net.Listener
+	sem      chan struct{} // bounds how many connections are served at once
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
 }
 
 // FileServerOptions is the options for the file server
 type FileServerOptions struct {
 	Network string
 	Address string
+
+	// SpoolDir, if set, persists resume state (how many bytes of each
+	// transfer have been received) to disk under this directory, so
+	// transfers can be resumed even across a server restart. If empty,
+	// resume state is kept in memory only.
+	SpoolDir string
+
+	// StorageDir is the directory received files are written to. Defaults
+	// to the current directory if empty.
+	StorageDir string
+
+	// TLSConfig, if set, makes the server accept TLS connections instead
+	// of plain TCP.
+	TLSConfig *tls.Config
+
+	// ChunkSize is the size, in bytes, of the chunks a chunked transfer
+	// (MessageChunkData) is split into. Defaults to defaultChunkSize.
+	ChunkSize int
+
+	// MaxConns bounds how many connections are served concurrently.
+	// Further accepted connections wait for a slot to free up before
+	// their handler goroutine starts, instead of spawning unboundedly.
+	// Defaults to defaultMaxConns.
+	MaxConns int
+
+	// IdleTimeout bounds how long a connection may sit waiting for its
+	// next frame before it's closed, so a client that connects and then
+	// goes silent doesn't hold a slot forever. Zero means no deadline.
+	IdleTimeout time.Duration
+
+	// ReadTimeout bounds how long a reply write may block waiting for the
+	// peer to read it (a slow or wedged peer can stall a TCP write just
+	// as easily as a slow read), applied as the connection's write
+	// deadline. Zero means no deadline.
+	ReadTimeout time.Duration
+
+	// Multiplexed, if true, treats every accepted connection as a Session
+	// (see AcceptSession) carrying many concurrent transfers on their own
+	// Streams, instead of one transfer at a time per connection. Defaults to
+	// false so existing single-transfer clients keep working unchanged.
+	Multiplexed bool
+}
+
+// NewFileServer builds a FileServer ready to accept connections.
+func NewFileServer(opts FileServerOptions) (*FileServer, error) {
+	if opts.StorageDir == "" {
+		opts.StorageDir = "."
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = defaultMaxConns
+	}
+	if err := os.MkdirAll(opts.StorageDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	fs := &FileServer{
+		Opts:  opts,
+		sem:   make(chan struct{}, opts.MaxConns),
+		conns: make(map[net.Conn]struct{}),
+	}
+
+	if opts.SpoolDir != "" {
+		store, err := newFileResumeStore(opts.SpoolDir)
+		if err != nil {
+			return nil, err
+		}
+		fs.store = store
+	} else {
+		fs.store = newMemoryResumeStore()
+	}
+
+	return fs, nil
 }
 
-// start starts the file server
+// start starts the file server. It blocks until Shutdown closes the
+// listener, then returns nil; any other Accept error is printed and the
+// loop keeps accepting. It returns an error only if listening fails.
 func (fs *FileServer) start() error {
 
-	// Listen for incoming connections.
-	listener, err := net.Listen(fs.Opts.Network, fs.Opts.Address)
+	// Listen for incoming connections, over TLS if a cert/key pair was
+	// configured.
+	var listener net.Listener
+	var err error
+	if fs.Opts.TLSConfig != nil {
+		listener, err = tls.Listen(fs.Opts.Network, fs.Opts.Address, fs.Opts.TLSConfig)
+	} else {
+		listener, err = net.Listen(fs.Opts.Network, fs.Opts.Address)
+	}
 	if err != nil {
 		return err
 	}
-
-	defer listener.Close()
+	fs.mu.Lock()
+	fs.listener = listener
+	fs.mu.Unlock()
 
 	for {
 		// Accept connection on port.
 		conn, err := listener.Accept()
 		if err != nil {
+			fs.mu.Lock()
+			shuttingDown := fs.closed
+			fs.mu.Unlock()
+			if shuttingDown {
+				return nil
+			}
 			fmt.Println("Error accepting: ", err.Error())
 			continue
 		}
 
+		// Count and register the connection before it may block waiting for
+		// a worker slot below, so Shutdown can never conclude every
+		// in-flight connection is done while this one is still waiting
+		// here: wg.Add after wg.Wait has already returned is a documented
+		// WaitGroup misuse, and a connection missing from fs.conns would
+		// also dodge Shutdown's force-close loop.
+		fs.wg.Add(1)
+		fs.mu.Lock()
+		fs.conns[conn] = struct{}{}
+		fs.mu.Unlock()
+
+		// Block here, rather than spawning unboundedly, once MaxConns
+		// connections are already being served.
+		fs.sem <- struct{}{}
+
 		// Handle connections in a new goroutine.
 		// The loop then returns to accepting, so that
 		// multiple connections may be served concurrently.
-		go fs.read(conn)
+		if fs.Opts.Multiplexed {
+			go fs.readSession(conn)
+		} else {
+			go fs.read(conn)
+		}
 	}
 }
 
+// read serves a single plain connection: its transfers' framed messages,
+// one transfer after another until the peer closes it, releasing its
+// worker-pool slot and deadlines once done.
 func (fs *FileServer) read(conn net.Conn) {
+	defer fs.wg.Done()
+	defer func() { <-fs.sem }()
+	defer func() {
+		fs.mu.Lock()
+		delete(fs.conns, conn)
+		fs.mu.Unlock()
+		conn.Close()
+	}()
+
+	fs.serveConn(conn)
+}
+
+// serveConn wraps serve with the per-connection read/write deadlines
+// configured on fs.Opts, then hands off to the shared frame-handling loop.
+func (fs *FileServer) serveConn(conn net.Conn) {
+	if fs.Opts.IdleTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(fs.Opts.IdleTimeout))
+	}
+	if fs.Opts.ReadTimeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(fs.Opts.ReadTimeout))
+	}
+	fs.serve(conn)
+}
+
+// readSession serves a single Opts.Multiplexed connection: it hands conn to
+// AcceptSession, which serves each stream the peer opens as an independent
+// transfer, releasing its worker-pool slot once the session closes.
+func (fs *FileServer) readSession(conn net.Conn) {
+	defer fs.wg.Done()
+	defer func() { <-fs.sem }()
+	defer func() {
+		fs.mu.Lock()
+		delete(fs.conns, conn)
+		fs.mu.Unlock()
+		conn.Close()
+	}()
+
+	fs.AcceptSession(conn)
+}
+
+// Shutdown stops accepting new connections, waits for in-flight transfers
+// to finish on their own up to ctx's deadline, then force-closes whatever
+// connections are still open.
+func (fs *FileServer) Shutdown(ctx context.Context) error {
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return nil
+	}
+	fs.closed = true
+	listener := fs.listener
+	fs.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		fs.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		fs.mu.Lock()
+		for conn := range fs.conns {
+			conn.Close()
+		}
+		fs.mu.Unlock()
+
+		<-done
+		return ctx.Err()
+	}
+}
+
+// AcceptSession multiplexes many concurrent transfers over one
+// connection: it wraps conn in a Session and serves each stream the peer
+// opens as an independent transfer, eliminating the head-of-line blocking
+// a one-transfer-per-connection model has when sending many files.
+func (fs *FileServer) AcceptSession(conn net.Conn) {
+	session := NewSession(conn)
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go fs.serve(stream)
+	}
+}
 
-	// Make a buffer to hold incoming data.
-	buf := new(bytes.Buffer)
+// serve runs the metadata/data handshake for one transfer over rw, which
+// may be a plain net.Conn or a multiplexed Stream.
+func (fs *FileServer) serve(rw io.ReadWriter) {
 
-	// Because we don't know how many bytes we're going to receive, we're going to use CopyN to read the bytes.
-	// But we need to know how many bytes to read, we're going to read the size from the connection first.
-	// We're going to use binary.Read to read the size from the connection.
+	// current and chunked hold the in-progress write for whichever
+	// transfer's MessageMetadata frame arrived most recently on this
+	// connection, depending on whether it's sent as one blob (MessageData)
+	// or as CRC-checked chunks (MessageChunkData).
+	var current *transferWrite
+	var chunked *chunkedReceive
 
-	// IMPORTANT: this needs to be declared outside of the loop otherwise
-	// it will be redeclared on each iteration of the loop and the loop will never end because the size will always be 0
-	var size int64
-	binary.Read(conn, binary.LittleEndian, &size)
+	// If rw is a real connection (as opposed to a multiplexed Stream, which
+	// has no deadlines of its own), refresh its idle-read deadline before
+	// each frame so IdleTimeout bounds the wait for the *next* frame, not
+	// just the first one.
+	deadliner, _ := rw.(interface {
+		SetReadDeadline(time.Time) error
+	})
 
+	// A connection now carries a sequence of independent, self-delimiting
+	// frames rather than a single size prefix read once up front. Looping
+	// on ReadFrame (instead of reusing a size read before the loop) is what
+	// lets multiple messages be streamed on one connection.
 	for {
-		// CopyN copies n bytes (or until an error) from src to dst.
-		reqLen, err := io.CopyN(buf, conn, size)
+		if deadliner != nil && fs.Opts.IdleTimeout > 0 {
+			deadliner.SetReadDeadline(time.Now().Add(fs.Opts.IdleTimeout))
+		}
+
+		frame, err := ReadFrame(rw)
 		if err != nil {
-			// If we get an error that is EOF, then we reached the end of the file and we can break out of the loop
+			// A clean EOF between frames just means the peer is done sending.
 			if err == io.EOF {
 				break
 			}
 
-			// If we get an error that is not EOF, then something went wrong and we should exit the function
-			log.Fatal(err)
+			log.Println("error reading frame:", err)
+			break
 		}
 
-		// Print the read bytes
-		fmt.Println(buf.Bytes())
+		// Likewise restart the write deadline for any reply to this frame,
+		// so ReadTimeout bounds each reply write rather than the connection.
+		if wd, ok := rw.(interface{ SetWriteDeadline(time.Time) error }); ok && fs.Opts.ReadTimeout > 0 {
+			wd.SetWriteDeadline(time.Now().Add(fs.Opts.ReadTimeout))
+		}
 
-		// Print the number of bytes received
-		fmt.Printf("Received %d bytes\n", reqLen)
-	}
-}
+		switch frame.Type {
+		case MessageQueryOffset:
+			id := TransferID(frame.Payload)
+			offset, _ := fs.store.Offset(id)
+			if err := writeOffset(rw, offset); err != nil {
+				log.Println("error replying with offset:", err)
+				return
+			}
 
-func send(size int) error {
+		case MessageMetadata:
+			meta, err := decodeMetadata(frame.Payload)
+			if err != nil {
+				log.Println("error decoding metadata frame:", err)
+				continue
+			}
 
-	/*
-		NOTE
-			This function mimics the client sending a file to the server, however ideally this would be a separate client application.
-			The client would connect to the server and send the file. But because this is a single application, we're just going to call the read function directly.
-			We are also not going to actually read a file from disk so we're just going to create a file of size and send it to the server.
-	*/
+			resumeOffset, _ := fs.store.Offset(meta.TransferID)
+			current, chunked = nil, nil
 
-	// create a file of size
-	file := make([]byte, size)
+			if meta.Chunked {
+				chunked, err = newChunkedReceive(fs.Opts.StorageDir, meta, fs.Opts.ChunkSize, resumeOffset)
+			} else {
+				current, err = openTransferFile(fs.Opts.StorageDir, meta, resumeOffset)
+			}
+			if err != nil {
+				log.Println("error opening destination file:", err)
+				if err := writeNack(rw, meta.TransferID, err.Error()); err != nil {
+					log.Println("error replying with nack:", err)
+					return
+				}
+			}
 
-	// Read the incoming connection into the buffer.
-	_, err := io.ReadFull(rand.Reader, file)
-	if err != nil {
-		return err
-	}
+		case MessageData:
+			id, chunk, err := decodeDataPayload(frame.Payload)
+			if err != nil {
+				log.Println("error decoding data frame:", err)
+				continue
+			}
 
-	// Connect to the server
-	conn, err := net.Dial("tcp", ":3000")
-	if err != nil {
-		return err
-	}
+			if current == nil || current.meta.TransferID != id {
+				log.Printf("received data for %q with no matching metadata\n", id)
+				continue
+			}
 
-	/*
-		NOTE
-			Because we don't know how many bytes we're going to send, we're going to use CopyN to send the bytes.
-			But we need to know how many bytes to send, we're going to send the size to the connection first.
-			We're going to use binary.Write to write the size to the connection.
-	*/
-	binary.Write(conn, binary.LittleEndian, int64(size))
+			if err := current.write(chunk); err != nil {
+				log.Println("error writing to destination file:", err)
+				continue
+			}
 
-	// CopyN copies n bytes (or until an error) from src to dst.
-	// It returns the number of bytes copied and the earliest error encountered while copying.
-	n, err := io.CopyN(conn, bytes.NewReader(file), int64(size))
-	if err != nil {
-		return err
-	}
+			if err := fs.store.SetOffset(id, int64(current.written)); err != nil {
+				log.Println("error persisting resume offset:", err)
+			}
 
-	// Print the number of bytes sent
-	fmt.Printf("Sent %d bytes\n", n)
+			fmt.Printf("Received %d bytes for transfer %q (%d/%d)\n", len(chunk), id, current.written, current.meta.Size)
 
-	// Close the connection when you're done with it.
-	// defer conn.Close()
+			if current.done() {
+				if err := current.verify(); err != nil {
+					log.Println("transfer failed verification:", err)
+					if err := writeNack(rw, id, err.Error()); err != nil {
+						log.Println("error replying with nack:", err)
+						return
+					}
+				} else if err := writeAck(rw, id); err != nil {
+					log.Println("error replying with ack:", err)
+					return
+				}
+				current = nil
+			}
 
-	return nil
+		case MessageChunkData:
+			id, seq, chunk, valid, err := decodeChunkPayload(frame.Payload)
+			if err != nil {
+				log.Println("error decoding chunk frame:", err)
+				continue
+			}
+
+			if chunked == nil || chunked.meta.TransferID != id {
+				log.Printf("received chunk for %q with no matching metadata\n", id)
+				continue
+			}
+
+			if !valid {
+				log.Printf("chunk %d of transfer %q failed CRC check, requesting retransmit\n", seq, id)
+				if err := writeChunkNack(rw, id, seq); err != nil {
+					log.Println("error replying with chunk nack:", err)
+					return
+				}
+				continue
+			}
+
+			if !chunked.seqInRange(seq) {
+				log.Printf("chunk %d of transfer %q is out of range for its %d-byte size, rejecting\n", seq, id, chunked.meta.Size)
+				if err := writeChunkNack(rw, id, seq); err != nil {
+					log.Println("error replying with chunk nack:", err)
+					return
+				}
+				continue
+			}
+
+			if err := chunked.writeChunk(seq, chunk); err != nil {
+				log.Println("error writing chunk to destination file:", err)
+				continue
+			}
+
+			received := chunked.bytesReceived()
+			if err := fs.store.SetOffset(id, int64(received)); err != nil {
+				log.Println("error persisting resume offset:", err)
+			}
+
+			fmt.Printf("Received chunk %d for transfer %q (%d/%d)\n", seq, id, received, chunked.meta.Size)
+
+			if chunked.done() {
+				if err := chunked.verify(); err != nil {
+					log.Println("transfer failed verification:", err)
+					if err := writeNack(rw, id, err.Error()); err != nil {
+						log.Println("error replying with nack:", err)
+						return
+					}
+				} else if err := writeAck(rw, id); err != nil {
+					log.Println("error replying with ack:", err)
+					return
+				}
+				chunked = nil
+			}
+
+		default:
+			fmt.Printf("ignoring frame with unknown message type %d\n", frame.Type)
+		}
+	}
 }
 
 func main() {
@@ -136,16 +451,56 @@ func main() {
 	go func() {
 		// wait 5 seconds before sending the file
 		time.Sleep(5 * time.Second)
-		send(1024 * 1024 * 10) // 10MB
-	}()
 
-	// Create the file server
-	server := &FileServer{
-		Opts: FileServerOptions{
+		client, err := NewClient(ClientOptions{
 			Network: "tcp",
 			Address: ":3000",
-		},
+			MinIdle: 1,
+			MaxIdle: 4,
+		})
+		if err != nil {
+			fmt.Println("error creating client:", err)
+			return
+		}
+		defer client.Close()
+
+		file, err := randomFile(1024 * 1024 * 10) // 10MB
+		if err != nil {
+			fmt.Println("error generating demo file:", err)
+			return
+		}
+
+		if err := client.SendFile("demo-transfer", "demo.bin", file); err != nil {
+			fmt.Println("error sending file:", err)
+		}
+	}()
+
+	// Create the file server
+	server, err := NewFileServer(FileServerOptions{
+		Network:     "tcp",
+		Address:     ":3000",
+		SpoolDir:    "spool",
+		StorageDir:  "received",
+		IdleTimeout: 30 * time.Second,
+		ReadTimeout: 30 * time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	log.Fatal(server.start())
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("error during shutdown:", err)
+		}
+	}()
+
+	if err := server.start(); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestShutdownWaitsForInFlightTransfers starts a server, opens a connection
+// that holds a transfer open, and checks Shutdown blocks until that
+// connection finishes on its own rather than severing it immediately.
+func TestShutdownWaitsForInFlightTransfers(t *testing.T) {
+	fs, err := NewFileServer(FileServerOptions{
+		Network:    "tcp",
+		Address:    "127.0.0.1:0",
+		StorageDir: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("NewFileServer: %v", err)
+	}
+
+	startErr := make(chan error, 1)
+	go func() { startErr <- fs.start() }()
+
+	addr := waitForListener(t, fs)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+
+	waitForConnCount(t, fs, 1)
+
+	// Hold the connection open (mid-"transfer") until Shutdown has had a
+	// chance to start waiting, then let it finish cleanly.
+	releaseClient := make(chan struct{})
+	go func() {
+		<-releaseClient
+		conn.Close()
+	}()
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdownDone <- fs.Shutdown(ctx)
+	}()
+
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the in-flight connection was released")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(releaseClient)
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Fatalf("Shutdown: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not return after the in-flight connection closed")
+	}
+
+	if err := <-startErr; err != nil {
+		t.Fatalf("start: %v", err)
+	}
+}
+
+// TestAcceptRegistersConnectionBeforeBlockingOnSemaphore uses MaxConns=1 to
+// force the accept loop to park on fs.sem for a second connection, then
+// checks that connection is already visible in fs.conns (and so counted by
+// wg/Shutdown's force-close loop) even though it's still waiting for a
+// worker slot.
+func TestAcceptRegistersConnectionBeforeBlockingOnSemaphore(t *testing.T) {
+	fs, err := NewFileServer(FileServerOptions{
+		Network:    "tcp",
+		Address:    "127.0.0.1:0",
+		StorageDir: t.TempDir(),
+		MaxConns:   1,
+	})
+	if err != nil {
+		t.Fatalf("NewFileServer: %v", err)
+	}
+
+	startErr := make(chan error, 1)
+	go func() { startErr <- fs.start() }()
+
+	addr := waitForListener(t, fs)
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer first.Close()
+	waitForConnCount(t, fs, 1)
+
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer second.Close()
+
+	// The sole worker slot is held by first's goroutine, so second is
+	// still parked on fs.sem here; it must still show up in fs.conns.
+	waitForConnCount(t, fs, 2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	first.Close()
+	second.Close()
+	if err := fs.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if err := <-startErr; err != nil {
+		t.Fatalf("start: %v", err)
+	}
+}
+
+func waitForListener(t *testing.T, fs *FileServer) string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		fs.mu.Lock()
+		l := fs.listener
+		fs.mu.Unlock()
+		if l != nil {
+			return l.Addr().String()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("server never started listening")
+	return ""
+}
+
+// waitForConnCount blocks until the server has registered n connections
+// (i.e. accepted them, whether or not they have a worker slot yet), so a
+// test can be sure Shutdown
+// will find them in flight instead of racing the accept goroutine.
+func waitForConnCount(t *testing.T, fs *FileServer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		fs.mu.Lock()
+		count := len(fs.conns)
+		fs.mu.Unlock()
+		if count >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("server never registered %d connection(s)", n)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileMetadata describes a file before its bytes are sent, so the
+// receiver can write it to disk with the right name, size, mode and
+// modification time, and verify its integrity once fully received.
+type FileMetadata struct {
+	TransferID TransferID
+	Filename   string
+	Size       uint64
+	Mode       uint32
+	ModTime    time.Time
+	SHA256     [32]byte
+
+	// Chunked tells the receiver whether the payload will arrive as one
+	// MessageData blob or as CRC-checked MessageChunkData chunks.
+	Chunked bool
+}
+
+// encodeMetadata packs m into a MessageMetadata frame payload:
+// [1 idLen][id][2 nameLen][name][8 size][4 mode][8 modtime unix][32 sha256][1 chunked].
+func encodeMetadata(m FileMetadata) []byte {
+	name := []byte(m.Filename)
+	buf := make([]byte, 1+len(m.TransferID)+2+len(name)+8+4+8+32+1)
+
+	i := 0
+	buf[i] = byte(len(m.TransferID))
+	i++
+	i += copy(buf[i:], m.TransferID)
+
+	binary.LittleEndian.PutUint16(buf[i:], uint16(len(name)))
+	i += 2
+	i += copy(buf[i:], name)
+
+	binary.LittleEndian.PutUint64(buf[i:], m.Size)
+	i += 8
+
+	binary.LittleEndian.PutUint32(buf[i:], m.Mode)
+	i += 4
+
+	binary.LittleEndian.PutUint64(buf[i:], uint64(m.ModTime.Unix()))
+	i += 8
+
+	i += copy(buf[i:], m.SHA256[:])
+
+	if m.Chunked {
+		buf[i] = 1
+	}
+
+	return buf
+}
+
+// decodeMetadata is the inverse of encodeMetadata.
+func decodeMetadata(payload []byte) (FileMetadata, error) {
+	var m FileMetadata
+
+	if len(payload) < 1 {
+		return m, errors.New("filestream: empty metadata payload")
+	}
+	i := 0
+
+	idLen := int(payload[i])
+	i++
+	if len(payload) < i+idLen+2 {
+		return m, errors.New("filestream: truncated metadata payload")
+	}
+	m.TransferID = TransferID(payload[i : i+idLen])
+	i += idLen
+
+	nameLen := int(binary.LittleEndian.Uint16(payload[i:]))
+	i += 2
+	if len(payload) < i+nameLen+8+4+8+32+1 {
+		return m, errors.New("filestream: truncated metadata payload")
+	}
+	m.Filename = string(payload[i : i+nameLen])
+	i += nameLen
+
+	m.Size = binary.LittleEndian.Uint64(payload[i:])
+	i += 8
+
+	m.Mode = binary.LittleEndian.Uint32(payload[i:])
+	i += 4
+
+	m.ModTime = time.Unix(int64(binary.LittleEndian.Uint64(payload[i:])), 0)
+	i += 8
+
+	copy(m.SHA256[:], payload[i:i+32])
+	i += 32
+
+	m.Chunked = payload[i] != 0
+
+	return m, nil
+}
+
+// sanitizeFilename validates that name is safe to join onto a storage
+// directory: no absolute path, and no ".." component that could escape
+// it via path traversal.
+func sanitizeFilename(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("filestream: empty filename")
+	}
+	if filepath.IsAbs(name) {
+		return "", fmt.Errorf("filestream: absolute filename %q not allowed", name)
+	}
+
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("filestream: filename %q escapes the storage directory", name)
+	}
+
+	return clean, nil
+}
+
+// transferWrite tracks the file and running checksum for a metadata
+// envelope's transfer while its data frames arrive.
+type transferWrite struct {
+	meta    FileMetadata
+	file    *os.File
+	hasher  hash.Hash
+	written uint64
+}
+
+// openTransferFile opens (or resumes) the destination file for meta under
+// storageDir, seeding the running checksum with any bytes already on disk
+// so it stays correct across a resumed transfer.
+func openTransferFile(storageDir string, meta FileMetadata, resumeOffset int64) (*transferWrite, error) {
+	name, err := sanitizeFilename(meta.Filename)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(storageDir, name)
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, os.FileMode(meta.Mode))
+	if err != nil {
+		return nil, err
+	}
+
+	hasher := sha256.New()
+	if resumeOffset > 0 {
+		existing, err := os.Open(path)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		_, err = io.CopyN(hasher, existing, resumeOffset)
+		existing.Close()
+		if err != nil {
+			file.Close()
+			// io.CopyN reports io.EOF (or io.ErrUnexpectedEOF) when the file
+			// on disk is shorter than resumeOffset: the resume state is
+			// stale, not a transient error, so say so rather than leaking
+			// the raw EOF up as a generic failure.
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, fmt.Errorf("filestream: resumed transfer %q expects %d bytes already on disk but found fewer: %w", meta.TransferID, resumeOffset, err)
+			}
+			return nil, fmt.Errorf("filestream: rehashing resumed transfer: %w", err)
+		}
+	}
+
+	if _, err := file.Seek(resumeOffset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &transferWrite{meta: meta, file: file, hasher: hasher, written: uint64(resumeOffset)}, nil
+}
+
+// write appends chunk to the destination file and running checksum.
+func (t *transferWrite) write(chunk []byte) error {
+	if _, err := t.file.Write(chunk); err != nil {
+		return err
+	}
+	t.hasher.Write(chunk)
+	t.written += uint64(len(chunk))
+	return nil
+}
+
+// done reports whether the whole file described by meta has arrived.
+func (t *transferWrite) done() bool {
+	return t.written >= t.meta.Size
+}
+
+// verify closes the file and checks the accumulated checksum against the
+// one advertised in the metadata.
+func (t *transferWrite) verify() error {
+	defer t.file.Close()
+	sum := t.hasher.Sum(nil)
+	if string(sum) != string(t.meta.SHA256[:]) {
+		return fmt.Errorf("filestream: checksum mismatch for %q", t.meta.Filename)
+	}
+	return nil
+}
+
+// writeAck sends a MessageAck frame confirming id was received intact.
+func writeAck(w io.Writer, id TransferID) error {
+	return WriteFrame(w, &Frame{Type: MessageAck, Payload: []byte(id)})
+}
+
+// writeNack sends a MessageNack frame reporting why id's transfer failed.
+func writeNack(w io.Writer, id TransferID, reason string) error {
+	payload := append([]byte(id+"\x00"), []byte(reason)...)
+	return WriteFrame(w, &Frame{Type: MessageNack, Payload: payload})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMetadataRoundTrip(t *testing.T) {
+	want := FileMetadata{
+		TransferID: "transfer-1",
+		Filename:   "report.pdf",
+		Size:       1234,
+		Mode:       0o644,
+		ModTime:    time.Unix(1700000000, 0),
+		SHA256:     sha256.Sum256([]byte("contents")),
+		Chunked:    true,
+	}
+
+	got, err := decodeMetadata(encodeMetadata(want))
+	if err != nil {
+		t.Fatalf("decodeMetadata: %v", err)
+	}
+
+	if got.TransferID != want.TransferID || got.Filename != want.Filename ||
+		got.Size != want.Size || got.Mode != want.Mode ||
+		!got.ModTime.Equal(want.ModTime) || got.SHA256 != want.SHA256 || got.Chunked != want.Chunked {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, want)
+	}
+}
+
+func TestSanitizeFilenameRejectsTraversal(t *testing.T) {
+	cases := []string{"../escaped", "/etc/passwd", "a/../../b", ".."}
+	for _, name := range cases {
+		if _, err := sanitizeFilename(name); err == nil {
+			t.Errorf("sanitizeFilename(%q): expected an error, got nil", name)
+		}
+	}
+}
+
+func TestTransferWriteChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	meta := FileMetadata{
+		TransferID: "transfer-1",
+		Filename:   "payload.bin",
+		Size:       5,
+		Mode:       0o644,
+		SHA256:     sha256.Sum256([]byte("wrong-contents")),
+	}
+
+	tw, err := openTransferFile(dir, meta, 0)
+	if err != nil {
+		t.Fatalf("openTransferFile: %v", err)
+	}
+
+	if err := tw.write([]byte("hello")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !tw.done() {
+		t.Fatal("expected done() to report true once Size bytes were written")
+	}
+
+	if err := tw.verify(); err == nil {
+		t.Fatal("expected a checksum mismatch error, got nil")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "payload.bin")); err != nil {
+		t.Fatalf("destination file should still exist after a failed verify: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TransferID identifies a single, possibly resumed, file transfer. It is
+// either a hash of the file's content or a client-supplied UUID, and is
+// sent in every frame belonging to that transfer.
+type TransferID string
+
+// resumeStore tracks how many bytes of each transfer have been durably
+// received, so a client that reconnects after a broken transfer can
+// resume from the last received byte instead of re-sending the whole
+// file.
+type resumeStore interface {
+	// Offset returns the number of bytes received for id, and whether any
+	// state is known for it at all.
+	Offset(id TransferID) (int64, bool)
+
+	// SetOffset records that offset bytes of id have now been received.
+	SetOffset(id TransferID, offset int64) error
+}
+
+// memoryResumeStore is a resumeStore that keeps state in memory only; it
+// is lost on restart, which is fine for a server that doesn't need to
+// survive one.
+type memoryResumeStore struct {
+	mu      sync.RWMutex
+	offsets map[TransferID]int64
+}
+
+func newMemoryResumeStore() *memoryResumeStore {
+	return &memoryResumeStore{offsets: make(map[TransferID]int64)}
+}
+
+func (s *memoryResumeStore) Offset(id TransferID) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	offset, ok := s.offsets[id]
+	return offset, ok
+}
+
+func (s *memoryResumeStore) SetOffset(id TransferID, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[id] = offset
+	return nil
+}
+
+// fileResumeStore is a resumeStore that persists one small file per
+// transfer under a spool directory, so resume state survives a server
+// restart.
+type fileResumeStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newFileResumeStore(dir string) (*fileResumeStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &fileResumeStore{dir: dir}, nil
+}
+
+func (s *fileResumeStore) Offset(id TransferID) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(id)
+	if err != nil {
+		return 0, false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+
+	offset, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return offset, true
+}
+
+func (s *fileResumeStore) SetOffset(id TransferID, offset int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(strconv.FormatInt(offset, 10)), 0o644)
+}
+
+// path builds the on-disk offset file path for id. id is attacker-supplied
+// (it arrives verbatim in MessageQueryOffset frames and FileMetadata
+// envelopes), so it must be validated the same way sanitizeFilename
+// validates a metadata filename: reject anything containing a path
+// separator or that could otherwise escape s.dir.
+func (s *fileResumeStore) path(id TransferID) (string, error) {
+	if id == "" {
+		return "", errors.New("filestream: empty transfer id")
+	}
+	if strings.ContainsAny(string(id), "/\\") {
+		return "", fmt.Errorf("filestream: transfer id %q contains a path separator", id)
+	}
+	if string(id) == ".." {
+		return "", fmt.Errorf("filestream: transfer id %q not allowed", id)
+	}
+	return filepath.Join(s.dir, fmt.Sprintf("%s.offset", id)), nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileResumeStoreRoundTrip(t *testing.T) {
+	store, err := newFileResumeStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newFileResumeStore: %v", err)
+	}
+
+	if _, ok := store.Offset("transfer-1"); ok {
+		t.Fatal("expected no offset for an unknown transfer")
+	}
+
+	if err := store.SetOffset("transfer-1", 42); err != nil {
+		t.Fatalf("SetOffset: %v", err)
+	}
+
+	offset, ok := store.Offset("transfer-1")
+	if !ok || offset != 42 {
+		t.Fatalf("Offset = %d, %v, want 42, true", offset, ok)
+	}
+}
+
+// TestFileResumeStoreRejectsPathTraversal reproduces a TransferID crafted
+// to escape the spool directory via filepath.Join, e.g. from a
+// MessageQueryOffset frame or a metadata envelope's TransferID field. Both
+// Offset and SetOffset must refuse to build a path outside dir rather than
+// silently reading or writing one.
+func TestFileResumeStoreRejectsPathTraversal(t *testing.T) {
+	dir := t.TempDir()
+	store, err := newFileResumeStore(filepath.Join(dir, "spool"))
+	if err != nil {
+		t.Fatalf("newFileResumeStore: %v", err)
+	}
+
+	malicious := []TransferID{
+		"../escaped",
+		"../../etc/important",
+		"..",
+		"a/b",
+		`a\b`,
+	}
+
+	for _, id := range malicious {
+		if err := store.SetOffset(id, 1); err == nil {
+			t.Errorf("SetOffset(%q): expected an error, got nil", id)
+		}
+		if _, ok := store.Offset(id); ok {
+			t.Errorf("Offset(%q): expected ok=false, got true", id)
+		}
+	}
+
+	// A successful traversal would have landed a file named "escaped" or
+	// "important" in dir (one level above the spool dir) or above; make
+	// sure nothing did.
+	entries, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("glob: %v", err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e, "escaped") || strings.Contains(e, "important") {
+			t.Fatalf("path traversal wrote outside the spool dir: %s", e)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// chunkRingLimit is how many of the most recently sent chunks a Sender
+// keeps around so it can retransmit one without re-reading the source.
+const chunkRingLimit = 32
+
+// chunkRing is a fixed-capacity ring buffer of unacknowledged chunks,
+// keyed by sequence number, used to cheaply retransmit one the peer
+// NACKed as corrupt.
+type chunkRing struct {
+	limit int
+	order []uint32
+	chunk map[uint32][]byte
+}
+
+func newChunkRing(limit int) *chunkRing {
+	return &chunkRing{limit: limit, chunk: make(map[uint32][]byte, limit)}
+}
+
+func (r *chunkRing) put(seq uint32, chunk []byte) {
+	r.chunk[seq] = chunk
+	r.order = append(r.order, seq)
+
+	if len(r.order) > r.limit {
+		oldest := r.order[0]
+		r.order = r.order[1:]
+		delete(r.chunk, oldest)
+	}
+}
+
+func (r *chunkRing) get(seq uint32) ([]byte, bool) {
+	chunk, ok := r.chunk[seq]
+	return chunk, ok
+}
+
+// Sender streams a file to a Frame-based peer as fixed-size, CRC-checked
+// chunks, retransmitting from its ring buffer whenever the peer reports
+// one arrived corrupt, so a single bad chunk doesn't require resending
+// the whole file.
+type Sender struct {
+	id        TransferID
+	r         io.ReaderAt
+	size      int64
+	chunkSize int
+}
+
+// NewSender builds a Sender for size bytes of r, split into chunkSize
+// chunks (defaultChunkSize if chunkSize is <= 0).
+func NewSender(id TransferID, r io.ReaderAt, size int64, chunkSize int) *Sender {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+	return &Sender{id: id, r: r, size: size, chunkSize: chunkSize}
+}
+
+// SendTo writes every chunk from startSeq onward to rw, honoring any
+// MessageChunkNack the peer sends back in the meantime, then waits for
+// the peer's final MessageAck/MessageNack for the whole transfer.
+func (s *Sender) SendTo(rw io.ReadWriter, startSeq uint32) error {
+	total := s.numChunks()
+
+	nackCh := make(chan uint32)
+	doneCh := make(chan *Frame, 1)
+	errCh := make(chan error, 1)
+	go s.watchNacks(rw, nackCh, doneCh, errCh)
+
+	ring := newChunkRing(chunkRingLimit)
+
+	for seq := startSeq; seq < total; seq++ {
+		chunk, err := s.readChunk(seq)
+		if err != nil {
+			return err
+		}
+		ring.put(seq, chunk)
+
+		if err := WriteFrame(rw, &Frame{Type: MessageChunkData, Payload: encodeChunkPayload(s.id, seq, chunk)}); err != nil {
+			return err
+		}
+
+		if err := s.drainNacks(rw, ring, nackCh, errCh); err != nil {
+			return err
+		}
+	}
+
+	// Every chunk has been written at least once, but a NACK for one of
+	// the last few may still be in flight; keep retransmitting until the
+	// peer confirms (or rejects) the whole transfer.
+	for {
+		select {
+		case seq := <-nackCh:
+			chunk, ok := ring.get(seq)
+			if !ok {
+				return fmt.Errorf("filestream: peer NACKed chunk %d, no longer available to retransmit", seq)
+			}
+			if err := WriteFrame(rw, &Frame{Type: MessageChunkData, Payload: encodeChunkPayload(s.id, seq, chunk)}); err != nil {
+				return err
+			}
+
+		case final := <-doneCh:
+			switch final.Type {
+			case MessageAck:
+				return nil
+			case MessageNack:
+				return fmt.Errorf("filestream: server rejected transfer %q: %s", s.id, final.Payload)
+			default:
+				return fmt.Errorf("filestream: unexpected reply type %d after chunks", final.Type)
+			}
+
+		case err := <-errCh:
+			return err
+		}
+	}
+}
+
+// drainNacks resends any already-sent chunks the peer has NACKed so far,
+// without blocking if there are none waiting.
+func (s *Sender) drainNacks(rw io.Writer, ring *chunkRing, nackCh <-chan uint32, errCh <-chan error) error {
+	for {
+		select {
+		case seq := <-nackCh:
+			chunk, ok := ring.get(seq)
+			if !ok {
+				return fmt.Errorf("filestream: peer NACKed chunk %d, no longer available to retransmit", seq)
+			}
+			if err := WriteFrame(rw, &Frame{Type: MessageChunkData, Payload: encodeChunkPayload(s.id, seq, chunk)}); err != nil {
+				return err
+			}
+		case err := <-errCh:
+			return err
+		default:
+			return nil
+		}
+	}
+}
+
+// watchNacks reads frames off rw in the background while SendTo is
+// writing chunks: MessageChunkNack frames are forwarded to nackCh so a
+// chunk can be retransmitted, and the terminal MessageAck/MessageNack for
+// the whole transfer is forwarded to doneCh.
+func (s *Sender) watchNacks(rw io.Reader, nackCh chan<- uint32, doneCh chan<- *Frame, errCh chan<- error) {
+	for {
+		frame, err := ReadFrame(rw)
+		if err != nil {
+			errCh <- err
+			return
+		}
+
+		switch frame.Type {
+		case MessageChunkNack:
+			id, seq, err := decodeChunkNack(frame.Payload)
+			if err != nil || id != s.id {
+				continue
+			}
+			nackCh <- seq
+
+		case MessageAck, MessageNack:
+			doneCh <- frame
+			return
+		}
+	}
+}
+
+func (s *Sender) numChunks() uint32 {
+	return numChunksFor(s.size, s.chunkSize)
+}
+
+func (s *Sender) readChunk(seq uint32) ([]byte, error) {
+	offset := int64(seq) * int64(s.chunkSize)
+	length := int64(s.chunkSize)
+	if remaining := s.size - offset; remaining < length {
+		length = remaining
+	}
+
+	chunk := make([]byte, length)
+	if _, err := s.r.ReadAt(chunk, offset); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return chunk, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// TestSenderRetransmitsNackedChunk simulates a peer that NACKs the first
+// chunk once (as if it arrived corrupt) before acking the whole transfer,
+// and checks that the Sender retransmits exactly that chunk rather than
+// giving up or resending everything.
+func TestSenderRetransmitsNackedChunk(t *testing.T) {
+	const id TransferID = "transfer-1"
+	const chunkSize = 4
+	file := []byte("aaaabbbb") // two 4-byte chunks: seq 0 "aaaa", seq 1 "bbbb"
+
+	client, peer := net.Pipe()
+	defer client.Close()
+	defer peer.Close()
+
+	var received [][]byte
+	peerErr := make(chan error, 1)
+	go func() {
+		// good tracks which sequences the peer has actually accepted, mirroring
+		// chunkedReceive: a NACKed chunk 0 doesn't count until it's resent, so
+		// the peer only acks once it has genuinely received every chunk, no
+		// matter what order the original and the retransmit arrive in.
+		good := map[uint32]bool{}
+		nackedSeq0 := false
+
+		for {
+			frame, err := ReadFrame(peer)
+			if err != nil {
+				peerErr <- err
+				return
+			}
+			if frame.Type != MessageChunkData {
+				peerErr <- nil
+				return
+			}
+
+			gotID, seq, chunk, valid, err := decodeChunkPayload(frame.Payload)
+			if err != nil || gotID != id || !valid {
+				peerErr <- err
+				return
+			}
+			received = append(received, append([]byte{}, chunk...))
+
+			if seq == 0 && !nackedSeq0 {
+				nackedSeq0 = true
+				if err := writeChunkNack(peer, id, 0); err != nil {
+					peerErr <- err
+					return
+				}
+				continue
+			}
+
+			good[seq] = true
+			if len(good) == 2 {
+				peerErr <- WriteFrame(peer, &Frame{Type: MessageAck, Payload: []byte(id)})
+				return
+			}
+		}
+	}()
+
+	sender := NewSender(id, bytes.NewReader(file), int64(len(file)), chunkSize)
+	if err := sender.SendTo(client, 0); err != nil {
+		t.Fatalf("SendTo: %v", err)
+	}
+	if err := <-peerErr; err != nil {
+		t.Fatalf("peer: %v", err)
+	}
+
+	// The retransmit of chunk 0 can land before or after chunk 1 depending
+	// on scheduling, so check contents rather than exact order: chunk 0
+	// arrives twice (original + retransmit) and chunk 1 once.
+	if len(received) != 3 {
+		t.Fatalf("peer received %d chunk frames, want 3 (seq0, retransmitted seq0, seq1): %q", len(received), received)
+	}
+	counts := map[string]int{}
+	for _, chunk := range received {
+		counts[string(chunk)]++
+	}
+	if counts["aaaa"] != 2 || counts["bbbb"] != 1 {
+		t.Fatalf("unexpected chunk contents: %q", received)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// StreamID identifies one of possibly many concurrent transfers
+// multiplexed over a single Session's connection.
+type StreamID uint32
+
+// Session multiplexes many Streams over one underlying connection,
+// interleaving DATA frames from each stream and applying per-stream flow
+// control so a single large or slow transfer can't starve the others,
+// and so concurrent reads and writes on one net.Conn stay well-defined.
+type Session struct {
+	conn net.Conn
+
+	writeMu sync.Mutex // serializes frame writes onto conn
+
+	mu      sync.Mutex
+	streams map[StreamID]*Stream
+	nextID  StreamID
+	closed  bool
+
+	acceptCh chan *Stream
+}
+
+// NewSession wraps conn in a Session and starts demuxing incoming frames
+// to their streams in the background.
+func NewSession(conn net.Conn) *Session {
+	s := &Session{
+		conn:     conn,
+		streams:  make(map[StreamID]*Stream),
+		acceptCh: make(chan *Stream, 32),
+	}
+	go s.readLoop()
+	return s
+}
+
+// OpenStream allocates a new, locally-initiated stream.
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errors.New("filestream: session is closed")
+	}
+
+	s.nextID++
+	id := s.nextID
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	return stream, nil
+}
+
+// AcceptStream blocks until the peer opens a new stream, or the session
+// closes.
+func (s *Session) AcceptStream() (*Stream, error) {
+	stream, ok := <-s.acceptCh
+	if !ok {
+		return nil, io.EOF
+	}
+	return stream, nil
+}
+
+// Close closes every open stream and the underlying connection.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	streams := s.streams
+	s.streams = nil
+	s.mu.Unlock()
+
+	close(s.acceptCh)
+	for _, stream := range streams {
+		stream.closeWithError(io.ErrClosedPipe)
+	}
+
+	return s.conn.Close()
+}
+
+// writeFrame serializes a single frame write onto the connection; it is
+// called concurrently by every stream's Write/Read, so it must lock.
+func (s *Session) writeFrame(f *Frame) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return WriteFrame(s.conn, f)
+}
+
+// readLoop demuxes incoming frames to their stream until the connection
+// fails, at which point it closes the session.
+func (s *Session) readLoop() {
+	defer s.Close()
+
+	for {
+		frame, err := ReadFrame(s.conn)
+		if err != nil {
+			return
+		}
+
+		switch frame.Type {
+		case MessageStreamData:
+			id, chunk, err := decodeStreamPayload(frame.Payload)
+			if err != nil {
+				continue
+			}
+			if stream := s.acceptStream(id); stream != nil {
+				stream.deliver(chunk)
+			}
+
+		case MessageWindowUpdate:
+			id, increment, err := decodeWindowUpdate(frame.Payload)
+			if err != nil {
+				continue
+			}
+			if stream := s.getStream(id); stream != nil {
+				stream.growSendWindow(increment)
+			}
+
+		case MessageStreamClose:
+			if len(frame.Payload) < 4 {
+				continue
+			}
+			id := StreamID(binary.LittleEndian.Uint32(frame.Payload))
+			if stream := s.getStream(id); stream != nil {
+				stream.closeRead()
+			}
+		}
+	}
+}
+
+func (s *Session) getStream(id StreamID) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// acceptStream returns the stream for id, registering (and announcing via
+// AcceptStream) a new one the first time the peer's data for it arrives.
+func (s *Session) acceptStream(id StreamID) *Stream {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	stream, ok := s.streams[id]
+	if ok {
+		s.mu.Unlock()
+		return stream
+	}
+
+	stream = newStream(id, s)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+	default:
+		// A full accept backlog means nobody is calling AcceptStream; drop
+		// the notification rather than block the demux loop for every
+		// other stream.
+	}
+
+	return stream
+}
+
+// encodeStreamPayload packs a StreamID and chunk into a MessageStreamData
+// payload: [4 byte id][chunk].
+func encodeStreamPayload(id StreamID, chunk []byte) []byte {
+	buf := make([]byte, 4+len(chunk))
+	binary.LittleEndian.PutUint32(buf, uint32(id))
+	copy(buf[4:], chunk)
+	return buf
+}
+
+// decodeStreamPayload is the inverse of encodeStreamPayload.
+func decodeStreamPayload(payload []byte) (StreamID, []byte, error) {
+	if len(payload) < 4 {
+		return 0, nil, errors.New("filestream: truncated stream data payload")
+	}
+	return StreamID(binary.LittleEndian.Uint32(payload)), payload[4:], nil
+}
+
+// windowUpdateFrame builds a MessageWindowUpdate frame granting the peer
+// increment more bytes it may send on stream id.
+func windowUpdateFrame(id StreamID, increment uint32) *Frame {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(id))
+	binary.LittleEndian.PutUint32(buf[4:8], increment)
+	return &Frame{Type: MessageWindowUpdate, Payload: buf}
+}
+
+// decodeWindowUpdate is the inverse of windowUpdateFrame.
+func decodeWindowUpdate(payload []byte) (StreamID, uint32, error) {
+	if len(payload) < 8 {
+		return 0, 0, errors.New("filestream: truncated window update payload")
+	}
+	return StreamID(binary.LittleEndian.Uint32(payload[0:4])), binary.LittleEndian.Uint32(payload[4:8]), nil
+}
+
+// streamCloseFrame builds a MessageStreamClose frame for stream id.
+func streamCloseFrame(id StreamID) *Frame {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(id))
+	return &Frame{Type: MessageStreamClose, Payload: buf}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// defaultStreamWindow is the number of bytes a peer is initially allowed
+// to send on a stream before it must wait for a WINDOW_UPDATE.
+const defaultStreamWindow = 64 * 1024
+
+// Stream is one multiplexed, flow-controlled transfer within a Session.
+// It implements io.ReadWriteCloser, so the existing frame-based transfer
+// logic (ReadFrame/WriteFrame and the metadata/data handshake) works
+// unmodified on top of it.
+type Stream struct {
+	id      StreamID
+	session *Session
+
+	// recvMu/recvCond guard the inbound queue. deliver (called from the
+	// Session's single demux goroutine) only ever appends under the lock
+	// and never blocks, so one stream with a stalled reader can't freeze
+	// delivery to every other stream sharing the connection; Read is the
+	// only side that waits.
+	recvMu     sync.Mutex
+	recvCond   *sync.Cond
+	recvQueue  [][]byte
+	recvBuf    []byte
+	recvClosed bool
+
+	mu         sync.Mutex
+	sendWindow uint32
+	windowCond *sync.Cond
+
+	closeOnce sync.Once
+	closedCh  chan struct{}
+}
+
+func newStream(id StreamID, session *Session) *Stream {
+	s := &Stream{
+		id:         id,
+		session:    session,
+		sendWindow: defaultStreamWindow,
+		closedCh:   make(chan struct{}),
+	}
+	s.recvCond = sync.NewCond(&s.recvMu)
+	s.windowCond = sync.NewCond(&s.mu)
+	return s
+}
+
+// ID returns the stream's identifier.
+func (s *Stream) ID() StreamID { return s.id }
+
+// Read blocks until data or the peer closing the stream is available.
+// Every byte read replenishes the peer's send window by that amount, via
+// a WINDOW_UPDATE, so it can keep sending without deadlocking on flow
+// control.
+func (s *Stream) Read(p []byte) (int, error) {
+	s.recvMu.Lock()
+	for len(s.recvBuf) == 0 {
+		if len(s.recvQueue) > 0 {
+			s.recvBuf = s.recvQueue[0]
+			s.recvQueue = s.recvQueue[1:]
+			break
+		}
+		if s.recvClosed {
+			s.recvMu.Unlock()
+			return 0, io.EOF
+		}
+		s.recvCond.Wait()
+	}
+	n := copy(p, s.recvBuf)
+	s.recvBuf = s.recvBuf[n:]
+	s.recvMu.Unlock()
+
+	if err := s.session.writeFrame(windowUpdateFrame(s.id, uint32(n))); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Write blocks until the peer's advertised window has room, splitting
+// large writes across as many DATA frames as needed so this stream can't
+// monopolize the underlying connection.
+func (s *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		s.mu.Lock()
+		for s.sendWindow == 0 {
+			select {
+			case <-s.closedCh:
+				s.mu.Unlock()
+				return written, io.ErrClosedPipe
+			default:
+			}
+			s.windowCond.Wait()
+		}
+
+		n := len(p) - written
+		if uint32(n) > s.sendWindow {
+			n = int(s.sendWindow)
+		}
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		chunk := p[written : written+n]
+		if err := s.session.writeFrame(&Frame{Type: MessageStreamData, Payload: encodeStreamPayload(s.id, chunk)}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// Close tells the peer no more data will be sent on this stream.
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closedCh)
+		s.windowCond.Broadcast()
+	})
+	return s.session.writeFrame(streamCloseFrame(s.id))
+}
+
+// deliver hands a chunk received from the peer to the stream's inbound
+// queue. It is called synchronously from the Session's single demux
+// goroutine, so it must never block: it only appends under recvMu and
+// wakes a waiting Read, regardless of how far behind that Read is.
+func (s *Stream) deliver(chunk []byte) {
+	s.recvMu.Lock()
+	if !s.recvClosed {
+		s.recvQueue = append(s.recvQueue, chunk)
+	}
+	s.recvMu.Unlock()
+	s.recvCond.Signal()
+}
+
+// closeRead marks the stream as having no more data coming, so a pending
+// or future Read returns io.EOF once the queue drains.
+func (s *Stream) closeRead() {
+	s.recvMu.Lock()
+	s.recvClosed = true
+	s.recvMu.Unlock()
+	s.recvCond.Broadcast()
+}
+
+// growSendWindow applies a WINDOW_UPDATE from the peer, unblocking any
+// Write waiting for room.
+func (s *Stream) growSendWindow(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	s.windowCond.Broadcast()
+}
+
+// closeWithError unblocks any pending Read/Write when the session dies.
+func (s *Stream) closeWithError(_ error) {
+	s.closeOnce.Do(func() {
+		close(s.closedCh)
+		s.windowCond.Broadcast()
+	})
+	s.closeRead()
+}